@@ -0,0 +1,265 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	sysfsBlockDir = "/sys/block"
+	devDir        = "/dev"
+	procMounts    = "/proc/mounts"
+)
+
+// resolveBackingDevice finds the physical block device backing a mounted
+// device that doesn't itself show up in /proc/diskstats: a device-mapper
+// crypt/linear target (dm-crypt, LUKS, and LUKS stacked on top of LVM) or an
+// ecryptfs mount layered over another filesystem.
+func resolveBackingDevice(device string, part partition) (*DeviceInfo, error) {
+	if part.fsType == "ecryptfs" {
+		return resolveEcryptfsBackingDevice(part.mountpoint, procMounts, sysfsBlockDir, devDir)
+	}
+	return resolveDeviceMapperBackingDevice(device, sysfsBlockDir, devDir)
+}
+
+// resolveDeviceMapperBackingDevice follows <sysfsBlockDir>/<dev>/slaves down
+// to the physical device underneath a chain of device-mapper targets. A
+// dm-crypt/LUKS volume has a single slave; when that volume was itself
+// provisioned from LVM, the slave is another dm-N device whose own slave is
+// the physical partition, so the walk continues until a device with no
+// slaves (or no slaves directory at all) is reached.
+func resolveDeviceMapperBackingDevice(device, sysfsBlockDir, devDir string) (*DeviceInfo, error) {
+	blockName, err := sysfsBlockName(device)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{blockName: true}
+	for {
+		slave, err := slaveBlockName(blockName, sysfsBlockDir)
+		if err != nil || slave == "" {
+			break
+		}
+		if seen[slave] {
+			return nil, fmt.Errorf("cycle detected resolving device-mapper slaves for %q", device)
+		}
+		seen[slave] = true
+		blockName = slave
+	}
+
+	backing, err := deviceInfoForBlockName(blockName, devDir)
+	if err != nil {
+		return nil, err
+	}
+	if backing.Device == device {
+		return nil, fmt.Errorf("%q has no underlying device", device)
+	}
+	return backing, nil
+}
+
+// slaveBlockName returns the single block device backing blockName, read
+// from sysfsBlockDir. When sysfsBlockDir lists blockName but has no slaves
+// directory for it, it falls back to `dmsetup deps`, which reports the same
+// relationship via the kernel's device-mapper ioctl. A name sysfsBlockDir
+// doesn't list at all yields "" without running dmsetup.
+func slaveBlockName(blockName, sysfsBlockDir string) (string, error) {
+	slaves, err := ioutil.ReadDir(filepath.Join(sysfsBlockDir, blockName, "slaves"))
+	if err == nil {
+		if len(slaves) == 0 {
+			return "", nil
+		}
+		// dm-crypt/linear targets have exactly one slave; take the first
+		// for the (rarer) multi-slave case, since we only need one path
+		// down to a physical device to report disk stats.
+		return slaves[0].Name(), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// blockName has no "slaves" directory and isn't recognized as a block
+	// device in sysfs at all - the common case for pseudo-filesystem
+	// mounts (overlay, tmpfs, proc, nfs, ...), which getFilteredFsInfo
+	// tries to resolve a backing device for on every stats interval since
+	// they never have their own /proc/diskstats entry either. Only shell
+	// out to dmsetup once sysfs confirms blockName is an actual
+	// device-mapper target; otherwise every non-block mount would fork a
+	// dmsetup process per interval, reintroducing the per-container
+	// subprocess cost that du.go removed for `du`.
+	if _, err := os.Stat(filepath.Join(sysfsBlockDir, blockName)); err != nil {
+		return "", nil
+	}
+
+	return dmsetupDeps(blockName)
+}
+
+// runDmsetupDeps runs `dmsetup deps -o blkdevname <name>` and returns its
+// output. It's a variable, rather than a direct exec.Command call, so tests
+// can substitute a fake implementation instead of shelling out to the real
+// dmsetup binary.
+var runDmsetupDeps = func(blockName string) ([]byte, error) {
+	return exec.Command("dmsetup", "deps", "-o", "blkdevname", blockName).Output()
+}
+
+// dmsetupDeps parses `dmsetup deps -o blkdevname <name>` output of the form
+// "1 dependencies  : (sda1)" into the dependency's block device name.
+func dmsetupDeps(blockName string) (string, error) {
+	out, err := runDmsetupDeps(blockName)
+	if err != nil {
+		return "", fmt.Errorf("dmsetup deps %s failed: %v", blockName, err)
+	}
+	start := strings.IndexByte(string(out), '(')
+	end := strings.IndexByte(string(out), ')')
+	if start < 0 || end < 0 || end < start {
+		return "", nil
+	}
+	return string(out)[start+1 : end], nil
+}
+
+// sysfsBlockName maps a /dev path to the name it's listed under in
+// /sys/block, resolving /dev/mapper/<name> symlinks to the dm-N they point
+// at.
+func sysfsBlockName(device string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		// Not every caller's device is guaranteed to exist under /dev in
+		// the current mount namespace; fall back to the path as given.
+		resolved = device
+	}
+	return path.Base(resolved), nil
+}
+
+func deviceInfoForBlockName(blockName, devDir string) (*DeviceInfo, error) {
+	devPath := path.Join(devDir, blockName)
+	buf := new(syscall.Stat_t)
+	if err := syscall.Stat(devPath, buf); err != nil {
+		return nil, fmt.Errorf("stat failed on %s with error: %s", devPath, err)
+	}
+	return &DeviceInfo{
+		Device: devPath,
+		Major:  major(buf.Rdev),
+		Minor:  minor(buf.Rdev),
+	}, nil
+}
+
+// resolveEcryptfsBackingDevice finds the device backing the lower
+// filesystem an ecryptfs mount is stacked on, by reading the lower
+// directory out of the mount's options in mountsFile and stat'ing it. When
+// the lower directory is itself a dm-crypt/LUKS mount, the result is
+// resolved one step further down to the physical device, to cover
+// ecryptfs stacked on top of dm-crypt.
+func resolveEcryptfsBackingDevice(mountpoint, mountsFile, sysfsBlockDir, devDir string) (*DeviceInfo, error) {
+	lower, err := ecryptfsLowerDir(mountpoint, mountsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(syscall.Stat_t)
+	if err := syscall.Stat(lower, buf); err != nil {
+		return nil, fmt.Errorf("stat failed on %s with error: %s", lower, err)
+	}
+	blockName, err := deviceNameForMajorMinor(major(buf.Dev), minor(buf.Dev), sysfsBlockDir)
+	if err != nil {
+		return nil, err
+	}
+	backing, err := deviceInfoForBlockName(blockName, devDir)
+	if err != nil {
+		return nil, err
+	}
+	if dm, err := resolveDeviceMapperBackingDevice(backing.Device, sysfsBlockDir, devDir); err == nil {
+		return dm, nil
+	}
+	return backing, nil
+}
+
+// ecryptfsLowerDir reads mountsFile for the ecryptfs mount at mountpoint
+// and returns the "ecryptfs_dir_lower" mount option, where ecryptfs-utils
+// records the directory being mounted over.
+func ecryptfsLowerDir(mountpoint, mountsFile string) (string, error) {
+	file, err := os.Open(mountsFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[1] != mountpoint || fields[2] != "ecryptfs" {
+			continue
+		}
+		for _, opt := range strings.Split(fields[3], ",") {
+			if strings.HasPrefix(opt, "ecryptfs_dir_lower=") {
+				return strings.TrimPrefix(opt, "ecryptfs_dir_lower="), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no ecryptfs_dir_lower option found for mount %q", mountpoint)
+}
+
+// deviceNameForMajorMinor finds the sysfsBlockDir entry whose dev file
+// matches major:minor, which is how sysfs exposes the reverse mapping we
+// need without hardcoding a naming scheme.
+func deviceNameForMajorMinor(maj, min uint, sysfsBlockDir string) (string, error) {
+	entries, err := ioutil.ReadDir(sysfsBlockDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		devFile := filepath.Join(sysfsBlockDir, entry.Name(), "dev")
+		contents, err := ioutil.ReadFile(devFile)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(contents)) == fmt.Sprintf("%d:%d", maj, min) {
+			return entry.Name(), nil
+		}
+		// Also check partitions of this device.
+		partName, err := partitionForMajorMinor(entry.Name(), maj, min, sysfsBlockDir)
+		if err == nil && partName != "" {
+			return partName, nil
+		}
+	}
+	return "", fmt.Errorf("no block device found for %d:%d", maj, min)
+}
+
+func partitionForMajorMinor(disk string, maj, min uint, sysfsBlockDir string) (string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsBlockDir, disk))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		devFile := filepath.Join(sysfsBlockDir, disk, entry.Name(), "dev")
+		contents, err := ioutil.ReadFile(devFile)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(contents)) == fmt.Sprintf("%d:%d", maj, min) {
+			return entry.Name(), nil
+		}
+	}
+	return "", nil
+}
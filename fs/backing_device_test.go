@@ -0,0 +1,247 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// makeFakeSysfsSlaves wires up /sys/block/<blockName>/slaves/<slaveName>
+// under root, the way the kernel exposes a device-mapper target's
+// dependency on the device(s) underneath it.
+func makeFakeSysfsSlaves(t *testing.T, root, blockName, slaveName string) {
+	t.Helper()
+	dir := filepath.Join(root, blockName, "slaves")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create %q: %v", dir, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, slaveName), nil, 0644); err != nil {
+		t.Fatalf("failed to create slave entry %q: %v", slaveName, err)
+	}
+}
+
+func TestResolveDeviceMapperBackingDevice(t *testing.T) {
+	tests := []struct {
+		name                string
+		device              string
+		deviceIsDevRootLeaf bool // true when device should resolve to devRoot/leaf, to exercise the "no underlying device" check
+		chain               map[string]string // blockName -> its single slave
+		leaf                string            // block with no further slaves
+		wantErr             bool
+	}{
+		{
+			name:   "dm-crypt directly on a physical partition",
+			device: "/dev/dm-0",
+			chain:  map[string]string{"dm-0": "sda1"},
+			leaf:   "sda1",
+		},
+		{
+			name:   "LUKS on top of LVM: two levels of indirection",
+			device: "/dev/dm-1",
+			chain: map[string]string{
+				"dm-1": "dm-0", // LUKS mapping
+				"dm-0": "sda1", // LVM logical volume
+			},
+			leaf: "sda1",
+		},
+		{
+			// The device itself is the leaf: resolveDeviceMapperBackingDevice
+			// must refuse to report a device as its own backing device.
+			name:                "no slaves: device has nothing underneath it",
+			deviceIsDevRootLeaf: true,
+			chain:               map[string]string{},
+			leaf:                "dm-2",
+			wantErr:             true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sysfsRoot, err := ioutil.TempDir("", "fs_sysfs_block")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(sysfsRoot)
+			devRoot, err := ioutil.TempDir("", "fs_dev")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(devRoot)
+
+			for blockName, slave := range tt.chain {
+				makeFakeSysfsSlaves(t, sysfsRoot, blockName, slave)
+			}
+			leafPath := filepath.Join(devRoot, tt.leaf)
+			if err := ioutil.WriteFile(leafPath, nil, 0644); err != nil {
+				t.Fatalf("failed to create %q: %v", leafPath, err)
+			}
+
+			device := tt.device
+			if tt.deviceIsDevRootLeaf {
+				device = leafPath
+			}
+			got, err := resolveDeviceMapperBackingDevice(device, sysfsRoot, devRoot)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveDeviceMapperBackingDevice(%q) = %+v, want error", tt.device, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveDeviceMapperBackingDevice(%q) returned error: %v", tt.device, err)
+			}
+			want := filepath.Join(devRoot, tt.leaf)
+			if got.Device != want {
+				t.Errorf("resolveDeviceMapperBackingDevice(%q).Device = %q, want %q", tt.device, got.Device, want)
+			}
+		})
+	}
+}
+
+func TestSlaveBlockNameFallsBackToDmsetup(t *testing.T) {
+	sysfsRoot, err := ioutil.TempDir("", "fs_sysfs_block")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(sysfsRoot)
+
+	// dm-0 is a recognized block device in sysfs (so slaveBlockName's
+	// existence gate passes) but has no "slaves" subdirectory, the way a
+	// device-mapper target looks on a kernel that doesn't expose it.
+	if err := os.MkdirAll(filepath.Join(sysfsRoot, "dm-0"), 0755); err != nil {
+		t.Fatalf("failed to create fake sysfs block dir: %v", err)
+	}
+
+	origRunDmsetupDeps := runDmsetupDeps
+	defer func() { runDmsetupDeps = origRunDmsetupDeps }()
+
+	var gotBlockName string
+	runDmsetupDeps = func(blockName string) ([]byte, error) {
+		gotBlockName = blockName
+		return []byte("1 dependencies  : (sda1)"), nil
+	}
+
+	got, err := slaveBlockName("dm-0", sysfsRoot)
+	if err != nil {
+		t.Fatalf("slaveBlockName(\"dm-0\") returned error: %v", err)
+	}
+	if gotBlockName != "dm-0" {
+		t.Errorf("runDmsetupDeps was called with %q, want \"dm-0\"", gotBlockName)
+	}
+	if want := "sda1"; got != want {
+		t.Errorf("slaveBlockName(\"dm-0\") = %q, want %q", got, want)
+	}
+}
+
+func TestSlaveBlockNameSkipsDmsetupForNonBlockDevices(t *testing.T) {
+	sysfsRoot, err := ioutil.TempDir("", "fs_sysfs_block")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(sysfsRoot)
+
+	origRunDmsetupDeps := runDmsetupDeps
+	defer func() { runDmsetupDeps = origRunDmsetupDeps }()
+
+	called := false
+	runDmsetupDeps = func(blockName string) ([]byte, error) {
+		called = true
+		return nil, fmt.Errorf("should not be called")
+	}
+
+	// "overlay" has no entry at all under sysfsRoot, the way a pseudo-
+	// filesystem mount's device name never matches a real block device.
+	got, err := slaveBlockName("overlay", sysfsRoot)
+	if err != nil {
+		t.Fatalf("slaveBlockName(\"overlay\") returned error: %v", err)
+	}
+	if got != "" {
+		t.Errorf("slaveBlockName(\"overlay\") = %q, want \"\"", got)
+	}
+	if called {
+		t.Errorf("slaveBlockName(\"overlay\") shelled out to dmsetup for a non-block-device name")
+	}
+}
+
+func TestResolveEcryptfsBackingDevice(t *testing.T) {
+	sysfsRoot, err := ioutil.TempDir("", "fs_sysfs_block")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(sysfsRoot)
+	devRoot, err := ioutil.TempDir("", "fs_dev")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(devRoot)
+
+	// ecryptfs is stacked on top of a dm-crypt volume (dm-0), which is
+	// itself a dm-crypt target on a physical partition (sda1).
+	lowerDir, err := ioutil.TempDir("", "fs_ecryptfs_lower")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(lowerDir)
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(lowerDir, &stat); err != nil {
+		t.Fatalf("failed to stat %q: %v", lowerDir, err)
+	}
+
+	blockDir := filepath.Join(sysfsRoot, "dm-0")
+	if err := os.MkdirAll(blockDir, 0755); err != nil {
+		t.Fatalf("failed to create %q: %v", blockDir, err)
+	}
+	devFile := fmt.Sprintf("%d:%d", major(stat.Dev), minor(stat.Dev))
+	if err := ioutil.WriteFile(filepath.Join(blockDir, "dev"), []byte(devFile), 0644); err != nil {
+		t.Fatalf("failed to write fake sysfs dev file: %v", err)
+	}
+	makeFakeSysfsSlaves(t, sysfsRoot, "dm-0", "sda1")
+	if err := ioutil.WriteFile(filepath.Join(devRoot, "dm-0"), nil, 0644); err != nil {
+		t.Fatalf("failed to create fake /dev entry: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(devRoot, "sda1"), nil, 0644); err != nil {
+		t.Fatalf("failed to create fake /dev entry: %v", err)
+	}
+
+	procDir, err := ioutil.TempDir("", "fs_proc")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(procDir)
+
+	mountpoint := "/mnt/encrypted"
+	mountsFile := filepath.Join(procDir, "mounts")
+	mountsContents := fmt.Sprintf("/dev/dm-0 %s ecryptfs rw,ecryptfs_dir_lower=%s 0 0\n", mountpoint, lowerDir)
+	if err := ioutil.WriteFile(mountsFile, []byte(mountsContents), 0644); err != nil {
+		t.Fatalf("failed to write fake mounts file: %v", err)
+	}
+
+	got, err := resolveEcryptfsBackingDevice(mountpoint, mountsFile, sysfsRoot, devRoot)
+	if err != nil {
+		t.Fatalf("resolveEcryptfsBackingDevice(%q) returned error: %v", mountpoint, err)
+	}
+	want := filepath.Join(devRoot, "sda1")
+	if got.Device != want {
+		t.Errorf("resolveEcryptfsBackingDevice(%q).Device = %q, want %q (should resolve through dm-0 to its physical slave)", mountpoint, got.Device, want)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,!legacy_du_exec
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// dirUsage walks dir in-process and returns the on-disk size of everything
+// under it in bytes, counted from allocated 512-byte blocks the way `du -s`
+// counts them rather than from apparent file length. It avoids forking a subprocess per container on
+// every stats interval, which dominates CPU on hosts running many pods.
+func dirUsage(dir string, timeout time.Duration) (uint64, error) {
+	rootStat := &syscall.Stat_t{}
+	if err := syscall.Lstat(dir, rootStat); err != nil {
+		return 0, fmt.Errorf("could not stat %q: %v", dir, err)
+	}
+	rootDevice := rootStat.Dev
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Hardlinked files are only counted once, keyed by inode number.
+	seenInodes := make(map[uint64]bool)
+
+	var size uint64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stat'ing %q took longer than %s", dir, timeout)
+		default:
+		}
+		if err != nil {
+			// The file may have been removed while we were walking.
+			return nil
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unsupported stat type for %q", path)
+		}
+
+		// Don't descend into other filesystems mounted below dir.
+		if path != dir && stat.Dev != rootDevice {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if stat.Nlink > 1 {
+			if seenInodes[stat.Ino] {
+				return nil
+			}
+			seenInodes[stat.Ino] = true
+		}
+
+		size += uint64(stat.Blocks) * 512
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux,!legacy_du_exec
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// makeSyntheticTree creates numDirs directories, each containing filesPerDir
+// 1KB files, rooted at a temporary directory.
+func makeSyntheticTree(tb testing.TB, numDirs, filesPerDir int) string {
+	root, err := ioutil.TempDir("", "fs_du_bench")
+	if err != nil {
+		tb.Fatalf("failed to create temp dir: %v", err)
+	}
+	content := make([]byte, 1024)
+	for d := 0; d < numDirs; d++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", d))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatalf("failed to create %q: %v", dir, err)
+		}
+		for f := 0; f < filesPerDir; f++ {
+			name := filepath.Join(dir, fmt.Sprintf("file%d", f))
+			if err := ioutil.WriteFile(name, content, 0644); err != nil {
+				tb.Fatalf("failed to write %q: %v", name, err)
+			}
+		}
+	}
+	return root
+}
+
+func TestDirUsage(t *testing.T) {
+	root := makeSyntheticTree(t, 10, 10)
+	defer os.RemoveAll(root)
+
+	usage, err := dirUsage(root, 30*time.Second)
+	if err != nil {
+		t.Fatalf("dirUsage(%q) failed: %v", root, err)
+	}
+	if usage == 0 {
+		t.Errorf("dirUsage(%q) = 0, want > 0", root)
+	}
+}
+
+func TestDirUsageEmptyDir(t *testing.T) {
+	if _, err := dirUsage("", time.Second); err == nil {
+		t.Errorf("dirUsage(\"\") should have failed")
+	}
+}
+
+// TestDirUsageHardlinkDedup verifies a hardlinked file is only counted once,
+// keyed by inode number, instead of once per directory entry pointing at it.
+// It compares against a directory holding just the one file rather than the
+// file's raw stat.Blocks, since dirUsage (like `du -s`) also counts the
+// enclosing directory entries' own on-disk size.
+func TestDirUsageHardlinkDedup(t *testing.T) {
+	content := make([]byte, 4096)
+
+	singleRoot, err := ioutil.TempDir("", "fs_du_hardlink_single")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(singleRoot)
+	if err := ioutil.WriteFile(filepath.Join(singleRoot, "original"), content, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	singleFileUsage, err := dirUsage(singleRoot, 30*time.Second)
+	if err != nil {
+		t.Fatalf("dirUsage(%q) failed: %v", singleRoot, err)
+	}
+
+	linkedRoot, err := ioutil.TempDir("", "fs_du_hardlink_linked")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(linkedRoot)
+	original := filepath.Join(linkedRoot, "original")
+	if err := ioutil.WriteFile(original, content, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	// Link the same inode under two more names in the tree. If hardlinks
+	// weren't deduped, usage would come out roughly 3x a single file's
+	// contribution instead of matching singleFileUsage.
+	for _, name := range []string{"link1", "link2"} {
+		if err := os.Link(original, filepath.Join(linkedRoot, name)); err != nil {
+			t.Fatalf("failed to link %q: %v", name, err)
+		}
+	}
+
+	linkedUsage, err := dirUsage(linkedRoot, 30*time.Second)
+	if err != nil {
+		t.Fatalf("dirUsage(%q) failed: %v", linkedRoot, err)
+	}
+	if linkedUsage != singleFileUsage {
+		t.Errorf("dirUsage(%q) = %d, want %d (same as a single copy of the file: hardlinks should only be counted once)", linkedRoot, linkedUsage, singleFileUsage)
+	}
+}
+
+// TestDirUsagePrunesOtherFilesystems verifies dirUsage doesn't descend into
+// a filesystem mounted below the directory it's summing. It mounts a tmpfs,
+// which needs CAP_SYS_ADMIN, so it skips rather than fails where that isn't
+// available (e.g. an unprivileged CI container).
+func TestDirUsagePrunesOtherFilesystems(t *testing.T) {
+	root, err := ioutil.TempDir("", "fs_du_mount")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "onroot"), make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	mountpoint := filepath.Join(root, "mounted")
+	if err := os.Mkdir(mountpoint, 0755); err != nil {
+		t.Fatalf("failed to create %q: %v", mountpoint, err)
+	}
+	if err := syscall.Mount("tmpfs", mountpoint, "tmpfs", 0, ""); err != nil {
+		t.Skipf("cannot mount tmpfs (missing CAP_SYS_ADMIN?): %v", err)
+	}
+	defer syscall.Unmount(mountpoint, 0)
+
+	if err := ioutil.WriteFile(filepath.Join(mountpoint, "onmount"), make([]byte, 16*1024*1024), 0644); err != nil {
+		t.Fatalf("failed to write file on tmpfs: %v", err)
+	}
+
+	rootOnlyUsage, err := dirUsage(root, 30*time.Second)
+	if err != nil {
+		t.Fatalf("dirUsage(%q) failed: %v", root, err)
+	}
+	mountedUsage, err := dirUsage(mountpoint, 30*time.Second)
+	if err != nil {
+		t.Fatalf("dirUsage(%q) failed: %v", mountpoint, err)
+	}
+	if mountedUsage == 0 {
+		t.Fatalf("dirUsage(%q) = 0, want > 0 (the 16MiB file on the tmpfs should count when summing it directly)", mountpoint)
+	}
+	if rootOnlyUsage >= mountedUsage {
+		t.Errorf("dirUsage(%q) = %d, want less than dirUsage(%q) = %d: it should not have descended into the tmpfs mounted below root", root, rootOnlyUsage, mountpoint, mountedUsage)
+	}
+}
+
+func benchmarkDirUsage(b *testing.B, numDirs, filesPerDir int) {
+	root := makeSyntheticTree(b, numDirs, filesPerDir)
+	defer os.RemoveAll(root)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dirUsage(root, time.Minute); err != nil {
+			b.Fatalf("dirUsage(%q) failed: %v", root, err)
+		}
+	}
+}
+
+func BenchmarkDirUsageSmall(b *testing.B) {
+	benchmarkDirUsage(b, 10, 100) // 1,000 files
+}
+
+func BenchmarkDirUsageLarge(b *testing.B) {
+	benchmarkDirUsage(b, 100, 200) // 20,000 files
+}
@@ -20,11 +20,8 @@ package fs
 import (
 	"bufio"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -38,18 +35,6 @@ type RealFsInfo struct {
 	fsStatsCache   FsStatsCache
 }
 
-type Context struct {
-	// docker root directory.
-	Docker  DockerContext
-	RktPath string
-}
-
-type DockerContext struct {
-	Root         string
-	Driver       string
-	DriverStatus map[string]string
-}
-
 func NewFsInfo(context Context) (FsInfo, error) {
 	fsInfo := &RealFsInfo{
 		partitionCache: NewPartitionCache(context),
@@ -98,6 +83,16 @@ func (self *RealFsInfo) GetMountpointForDevice(dev string) (string, error) {
 func (self *RealFsInfo) getFilteredFsInfo(filter func(_ string, _ partition) bool, withIoStats bool) ([]Fs, error) {
 	filesystemsOut := make([]Fs, 0)
 
+	// TODO: Use a cache here as well?
+	var diskStatsMap map[string]DiskStats
+	if withIoStats {
+		var err error
+		diskStatsMap, err = getDiskStatsMap("/proc/diskstats", sysfsBlockDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err := self.partitionCache.ApplyOverPartitions(func(device string, partition partition) error {
 		if !filter(device, partition) {
 			return nil
@@ -122,6 +117,23 @@ func (self *RealFsInfo) getFilteredFsInfo(filter func(_ string, _ partition) boo
 			Minor:  uint(partition.minor),
 		}
 
+		if withIoStats {
+			if diskStats, ok := diskStatsMap[device]; ok {
+				fs.DiskStats = diskStats
+			} else if backing, resolveErr := resolveBackingDevice(device, partition); resolveErr == nil {
+				// device doesn't appear in /proc/diskstats on its own - this
+				// is expected for dm-crypt/LUKS mappings and ecryptfs
+				// mounts, whose disk stats live on the underlying physical
+				// device instead.
+				fs.BackingDevice = backing
+				if diskStats, ok := diskStatsMap[backing.Device]; ok {
+					fs.DiskStats = diskStats
+				}
+			} else {
+				glog.V(4).Infof("Disk stats for %q not found: %v", device, resolveErr)
+			}
+		}
+
 		filesystemsOut = append(filesystemsOut, fs)
 		return nil
 	})
@@ -130,27 +142,6 @@ func (self *RealFsInfo) getFilteredFsInfo(filter func(_ string, _ partition) boo
 		return nil, err
 	}
 
-	// TODO: Use a cache here as well?
-	if withIoStats {
-		diskStatsMap, err := getDiskStatsMap("/proc/diskstats")
-		if err != nil {
-			return nil, err
-		}
-
-		for _, fs := range filesystemsOut {
-			diskStats, ok := diskStatsMap[fs.DeviceInfo.Device]
-			if !ok {
-				// TODO: ecryptfs breaks with this, since the disk stats we should
-				// report are the disk stats for the underlying physical volume, not
-				// the ecryptfs one. We should (probably) handle ecryptfs a little
-				// differently here, and look at the disk stats for the lower layer.
-				// glog.Warningf("Disk stats for %q not found", fs.DeviceInfo.Device)
-				continue
-			}
-			fs.DiskStats = diskStats
-		}
-	}
-
 	return filesystemsOut, nil
 }
 
@@ -174,9 +165,7 @@ func (self *RealFsInfo) GetGlobalFsInfo(withIoStats bool) ([]Fs, error) {
 	}, withIoStats)
 }
 
-var partitionRegex = regexp.MustCompile(`^(?:(?:s|xv)d[a-z]+\d*|dm-\d+)$`)
-
-func getDiskStatsMap(diskStatsFile string) (map[string]DiskStats, error) {
+func getDiskStatsMap(diskStatsFile, sysfsBlockDir string) (map[string]DiskStats, error) {
 	diskStatsMap := make(map[string]DiskStats)
 	file, err := os.Open(diskStatsFile)
 	if err != nil {
@@ -190,10 +179,16 @@ func getDiskStatsMap(diskStatsFile string) (map[string]DiskStats, error) {
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
 
+	allowed, sysfsAvailable := blockDeviceAllowList(sysfsBlockDir)
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		words := strings.Fields(line)
-		if !partitionRegex.MatchString(words[2]) {
+		if sysfsAvailable {
+			if !allowed[words[2]] {
+				continue
+			}
+		} else if !legacyPartitionRegex.MatchString(words[2]) {
 			continue
 		}
 		// 8      50 sdd2 40 0 280 223 7 0 22 108 0 330 330
@@ -256,37 +251,5 @@ func (self *RealFsInfo) GetDirUsage(dir string, timeout time.Duration) (uint64,
 	if dir == "" {
 		return 0, fmt.Errorf("invalid directory")
 	}
-	cmd := exec.Command("nice", "-n", "19", "du", "-s", dir)
-	stdoutp, err := cmd.StdoutPipe()
-	if err != nil {
-		return 0, fmt.Errorf("failed to setup stdout for cmd %v - %v", cmd.Args, err)
-	}
-	stderrp, err := cmd.StderrPipe()
-	if err != nil {
-		return 0, fmt.Errorf("failed to setup stderr for cmd %v - %v", cmd.Args, err)
-	}
-
-	if err := cmd.Start(); err != nil {
-		return 0, fmt.Errorf("failed to exec du - %v", err)
-	}
-	stdoutb, souterr := ioutil.ReadAll(stdoutp)
-	stderrb, _ := ioutil.ReadAll(stderrp)
-	timer := time.AfterFunc(timeout, func() {
-		glog.Infof("killing cmd %v due to timeout(%s)", cmd.Args, timeout.String())
-		cmd.Process.Kill()
-	})
-	err = cmd.Wait()
-	timer.Stop()
-	if err != nil {
-		return 0, fmt.Errorf("du command failed on %s with output stdout: %s, stderr: %s - %v", dir, string(stdoutb), string(stderrb), err)
-	}
-	stdout := string(stdoutb)
-	if souterr != nil {
-		glog.Errorf("failed to read from stdout for cmd %v - %v", cmd.Args, souterr)
-	}
-	usageInKb, err := strconv.ParseUint(strings.Fields(stdout)[0], 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("cannot parse 'du' output %s - %s", stdout, err)
-	}
-	return usageInKb * 1024, nil
+	return dirUsage(dir, timeout)
 }
@@ -0,0 +1,120 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a single /proc/diskstats row for device, with arbitrary but valid stats.
+const diskStatsRow = "8 0 %s 40 0 280 223 7 0 22 108 0 330 330"
+
+// makeFakeSysfsBlock lays out sysfsBlockDir/<disk>[/<partition>, ...] for
+// each disk in layout, the way /sys/block looks for that device class.
+func makeFakeSysfsBlock(t *testing.T, root string, layout map[string][]string) {
+	t.Helper()
+	for disk, partitions := range layout {
+		if err := os.MkdirAll(filepath.Join(root, disk), 0755); err != nil {
+			t.Fatalf("failed to create %q: %v", disk, err)
+		}
+		for _, partition := range partitions {
+			if err := os.MkdirAll(filepath.Join(root, disk, partition), 0755); err != nil {
+				t.Fatalf("failed to create %q: %v", partition, err)
+			}
+		}
+	}
+}
+
+func TestGetDiskStatsMapDeviceClasses(t *testing.T) {
+	tests := []struct {
+		name       string
+		device     string
+		sysfsBlock map[string][]string // disk -> partitions
+	}{
+		{name: "scsi/sata", device: "sda1", sysfsBlock: map[string][]string{"sda": {"sda1"}}},
+		{name: "xen", device: "xvda1", sysfsBlock: map[string][]string{"xvda": {"xvda1"}}},
+		{name: "device-mapper", device: "dm-0", sysfsBlock: map[string][]string{"dm-0": nil}},
+		{name: "nvme", device: "nvme0n1p1", sysfsBlock: map[string][]string{"nvme0n1": {"nvme0n1p1"}}},
+		{name: "mmc", device: "mmcblk0p1", sysfsBlock: map[string][]string{"mmcblk0": {"mmcblk0p1"}}},
+		{name: "md raid", device: "md0", sysfsBlock: map[string][]string{"md0": nil}},
+		{name: "loop", device: "loop0", sysfsBlock: map[string][]string{"loop0": nil}},
+		{name: "virtio", device: "vda1", sysfsBlock: map[string][]string{"vda": {"vda1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sysfsRoot, err := ioutil.TempDir("", "fs_sysfs_block")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(sysfsRoot)
+			makeFakeSysfsBlock(t, sysfsRoot, tt.sysfsBlock)
+
+			diskStatsFile := filepath.Join(sysfsRoot, "diskstats")
+			contents := fmt.Sprintf(diskStatsRow+"\n", tt.device)
+			if err := ioutil.WriteFile(diskStatsFile, []byte(contents), 0644); err != nil {
+				t.Fatalf("failed to write fake diskstats file: %v", err)
+			}
+
+			got, err := getDiskStatsMap(diskStatsFile, sysfsRoot)
+			if err != nil {
+				t.Fatalf("getDiskStatsMap returned error: %v", err)
+			}
+			wantDevice := filepath.Join("/dev", tt.device)
+			if _, ok := got[wantDevice]; !ok {
+				t.Errorf("getDiskStatsMap() = %v, want an entry for %q", got, wantDevice)
+			}
+		})
+	}
+}
+
+func TestGetDiskStatsMapFallsBackToLegacyRegexWithoutSysfs(t *testing.T) {
+	sysfsRoot, err := ioutil.TempDir("", "fs_sysfs_block")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	// Remove it so blockDeviceAllowList sees it as unavailable, the way it
+	// would on a host where /sys/block isn't mounted in cAdvisor's
+	// namespace.
+	os.RemoveAll(sysfsRoot)
+
+	procDir, err := ioutil.TempDir("", "fs_proc")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(procDir)
+	diskStatsFile := filepath.Join(procDir, "diskstats")
+	contents := fmt.Sprintf(diskStatsRow+"\n"+diskStatsRow+"\n", "sda1", "nvme0n1p1")
+	if err := ioutil.WriteFile(diskStatsFile, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed to write fake diskstats file: %v", err)
+	}
+
+	got, err := getDiskStatsMap(diskStatsFile, sysfsRoot)
+	if err != nil {
+		t.Fatalf("getDiskStatsMap returned error: %v", err)
+	}
+	if _, ok := got["/dev/sda1"]; !ok {
+		t.Errorf("getDiskStatsMap() = %v, want an entry for /dev/sda1 via the legacy regex fallback", got)
+	}
+	if _, ok := got["/dev/nvme0n1p1"]; ok {
+		t.Errorf("getDiskStatsMap() = %v, want no entry for /dev/nvme0n1p1: the legacy regex doesn't recognize NVMe devices", got)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+// Provides Filesystem Stats for Windows hosts running Windows containers
+// (HCS).
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/windows"
+)
+
+type RealFsInfo struct {
+	partitionCache PartitionCache
+	fsStatsCache   FsStatsCache
+}
+
+func NewFsInfo(context Context) (FsInfo, error) {
+	fsInfo := &RealFsInfo{
+		partitionCache: NewPartitionCache(context),
+		fsStatsCache:   NewFsStatsCache(),
+	}
+
+	glog.Infof("Listing filesystem partitions:")
+	fsInfo.partitionCache.ApplyOverPartitions(func(d string, p partition) error {
+		glog.Infof("%s: %+v", d, p)
+		return nil
+	})
+
+	return fsInfo, nil
+}
+
+func (self *RealFsInfo) RefreshCache() {
+	err := self.partitionCache.Refresh()
+	if err != nil {
+		glog.Warningf("Failed to refresh partition cache: %s", err)
+	}
+}
+
+func (self *RealFsInfo) GetDeviceForLabel(label string) (string, error) {
+	return self.partitionCache.DeviceNameForLabel(label)
+}
+
+func (self *RealFsInfo) GetLabelsForDevice(device string) ([]string, error) {
+	labels := make([]string, 0)
+	self.partitionCache.ApplyOverLabels(func(label string, deviceForLabel string) error {
+		if device == deviceForLabel {
+			labels = append(labels, label)
+		}
+		return nil
+	})
+	return labels, nil
+}
+
+func (self *RealFsInfo) GetMountpointForDevice(dev string) (string, error) {
+	p, err := self.partitionCache.PartitionForDevice(dev)
+	if err != nil {
+		return "", err
+	}
+	return p.mountpoint, nil
+}
+
+func (self *RealFsInfo) getFilteredFsInfo(filter func(_ string, _ partition) bool, withIoStats bool) ([]Fs, error) {
+	filesystemsOut := make([]Fs, 0)
+
+	err := self.partitionCache.ApplyOverPartitions(func(device string, partition partition) error {
+		if !filter(device, partition) {
+			return nil
+		}
+
+		var (
+			fs  Fs
+			err error
+		)
+
+		fs.Type, fs.Capacity, fs.Free, fs.Available, fs.Inodes, fs.InodesFree, err = self.fsStatsCache.FsStats(device, partition)
+		if err != nil {
+			// Only log, don't return an error, move on to the next FS
+			glog.Errorf("Stat fs for %q failed. Error: %v", device, err)
+			return nil
+		}
+
+		fs.DeviceInfo = DeviceInfo{
+			Device: device,
+			Major:  uint(partition.major),
+			Minor:  uint(partition.minor),
+		}
+
+		if withIoStats {
+			diskStats, err := getVolumeDiskStats(device)
+			if err != nil {
+				glog.V(4).Infof("disk stats for %q not found: %v", device, err)
+			} else {
+				fs.DiskStats = diskStats
+			}
+		}
+
+		filesystemsOut = append(filesystemsOut, fs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return filesystemsOut, nil
+}
+
+func (self *RealFsInfo) GetFsInfoForMounts(mountSet map[string]struct{}, withIoStats bool) ([]Fs, error) {
+	return self.getFilteredFsInfo(func(_ string, partition partition) bool {
+		_, hasMount := mountSet[partition.mountpoint]
+		return hasMount
+	}, withIoStats)
+}
+
+func (self *RealFsInfo) GetFsInfoForDevices(deviceSet map[string]struct{}, withIoStats bool) ([]Fs, error) {
+	return self.getFilteredFsInfo(func(device string, _ partition) bool {
+		_, hasDevice := deviceSet[device]
+		return hasDevice
+	}, withIoStats)
+}
+
+func (self *RealFsInfo) GetGlobalFsInfo(withIoStats bool) ([]Fs, error) {
+	return self.getFilteredFsInfo(func(_ string, _ partition) bool {
+		return true
+	}, withIoStats)
+}
+
+func (self *RealFsInfo) GetDirFsDevice(dir string) (*DeviceInfo, error) {
+	volume, err := volumeNameForPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("stat failed on %s with error: %s", dir, err)
+	}
+	p, err := self.partitionCache.PartitionForDevice(volume)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceInfo{
+		Device: volume,
+		Major:  p.major,
+		Minor:  p.minor,
+	}, nil
+}
+
+// GetDirUsage walks dir in-process and sums the apparent size of every file
+// under it. There is no `du` equivalent shipped with Windows, so unlike
+// Linux this is the only implementation - it is not exec based.
+func (self *RealFsInfo) GetDirUsage(dir string, timeout time.Duration) (uint64, error) {
+	if dir == "" {
+		return 0, fmt.Errorf("invalid directory")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	var size uint64
+	var walkErr error
+	go func() {
+		defer close(done)
+		walkErr = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("stat'ing %q took longer than %s", dir, timeout)
+			default:
+			}
+			if err != nil {
+				// The file may have been removed while we were walking.
+				return nil
+			}
+			if !info.IsDir() {
+				size += uint64(info.Size())
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case <-done:
+		return size, walkErr
+	case <-ctx.Done():
+		// Cancel lets the walk goroutine above notice ctx.Done() at its
+		// next callback and unwind, instead of leaking a walk over the
+		// rest of dir in the background.
+		return 0, fmt.Errorf("stat'ing %q took longer than %s", dir, timeout)
+	}
+}
+
+// volumeNameForPath resolves dir to the `\\?\Volume{GUID}\` path of the
+// volume it lives on.
+func volumeNameForPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]uint16, windows.MAX_PATH)
+	pathp, err := windows.UTF16PtrFromString(abs)
+	if err != nil {
+		return "", err
+	}
+	if err := windows.GetVolumePathName(pathp, &buf[0], uint32(len(buf))); err != nil {
+		return "", err
+	}
+	volBuf := make([]uint16, windows.MAX_PATH)
+	if err := windows.GetVolumeNameForVolumeMountPoint(&buf[0], &volBuf[0], uint32(len(volBuf))); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(volBuf), nil
+}
+
+// dockerWindowsfilterRoot returns the directory windowsfilter, the graph
+// driver used by the Windows Docker daemon, stores container layers in,
+// given the docker root directory reported in DockerContext.
+func dockerWindowsfilterRoot(docker DockerContext) string {
+	root := docker.Root
+	if root == "" {
+		root = `C:\ProgramData\docker`
+	}
+	if !strings.EqualFold(docker.Driver, "windowsfilter") {
+		return ""
+	}
+	return filepath.Join(root, "windowsfilter")
+}
+
+const (
+	methodBuffered  = 0
+	fileAnyAccess   = 0
+	fileDeviceDisk  = 0x00000007
+	ioctlDiskBase   = fileDeviceDisk
+	ioctlDiskPerf   = (ioctlDiskBase << 16) | (fileAnyAccess << 14) | (0x0008 << 2) | methodBuffered
+	ioctlVolDiskExt = (uint32('V') << 16) | (fileAnyAccess << 14) | (0 << 2) | methodBuffered
+)
+
+// diskPerformance mirrors the Win32 DISK_PERFORMANCE structure returned by
+// IOCTL_DISK_PERFORMANCE field for field; only some of its counters are
+// copied into DiskStats. StorageManagerName is sized generously so the
+// buffer passed to DeviceIoControl is never smaller than the real struct.
+type diskPerformance struct {
+	BytesRead           int64
+	BytesWritten        int64
+	ReadTime            int64
+	WriteTime           int64
+	IdleTime            int64
+	ReadCount           uint32
+	WriteCount          uint32
+	QueueDepth          uint32
+	SplitCount          uint32
+	QueryTime           int64
+	StorageDeviceNumber uint32
+	StorageManagerName  [16]uint16
+}
+
+// getVolumeDiskStats maps a volume GUID path back to the physical disk
+// holding its first extent via IOCTL_VOLUME_GET_VOLUME_DISK_EXTENTS, then
+// reads IOCTL_DISK_PERFORMANCE counters for that disk. Other disks of a
+// volume spanning several are not read.
+func getVolumeDiskStats(volume string) (DiskStats, error) {
+	h, err := openDeviceHandle(strings.TrimSuffix(volume, `\`))
+	if err != nil {
+		return DiskStats{}, err
+	}
+	defer windows.CloseHandle(h)
+
+	diskNumber, err := volumeDiskExtent(h)
+	if err != nil {
+		return DiskStats{}, err
+	}
+
+	diskHandle, err := openDeviceHandle(fmt.Sprintf(`\\.\PhysicalDrive%d`, diskNumber))
+	if err != nil {
+		return DiskStats{}, err
+	}
+	defer windows.CloseHandle(diskHandle)
+
+	var perf diskPerformance
+	var bytesReturned uint32
+	if err := windows.DeviceIoControl(diskHandle, ioctlDiskPerf, nil, 0,
+		(*byte)(unsafe.Pointer(&perf)), uint32(unsafe.Sizeof(perf)), &bytesReturned, nil); err != nil {
+		return DiskStats{}, fmt.Errorf("IOCTL_DISK_PERFORMANCE failed: %v", err)
+	}
+
+	return DiskStats{
+		ReadsCompleted:  uint64(perf.ReadCount),
+		WritesCompleted: uint64(perf.WriteCount),
+		SectorsRead:     uint64(perf.BytesRead) / 512,
+		SectorsWritten:  uint64(perf.BytesWritten) / 512,
+		ReadTime:        uint64(perf.ReadTime),
+		WriteTime:       uint64(perf.WriteTime),
+		IoInProgress:    uint64(perf.QueueDepth),
+	}, nil
+}
+
+func openDeviceHandle(path string) (windows.Handle, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	return windows.CreateFile(p, windows.GENERIC_READ, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil, windows.OPEN_EXISTING, 0, 0)
+}
+
+// volumeDiskExtents mirrors the Win32 VOLUME_DISK_EXTENTS structure for the
+// common case of a volume backed by a single, non-spanned physical disk.
+// DISK_EXTENT's StartingOffset/ExtentLength are LARGE_INTEGERs, which need
+// 8-byte alignment, so the compiler inserts 4 bytes of padding between
+// NumberOfDiskExtents and DiskNumber; _pad reserves that so DiskNumber
+// lands at the real offset 8 instead of 4.
+type volumeDiskExtents struct {
+	NumberOfDiskExtents uint32
+	_pad                uint32
+	DiskNumber          uint32
+	_pad2               uint32
+	StartingOffset      int64
+	ExtentLength        int64
+}
+
+func volumeDiskExtent(h windows.Handle) (uint32, error) {
+	var extents volumeDiskExtents
+	var bytesReturned uint32
+	if err := windows.DeviceIoControl(h, ioctlVolDiskExt, nil, 0,
+		(*byte)(unsafe.Pointer(&extents)), uint32(unsafe.Sizeof(extents)), &bytesReturned, nil); err != nil {
+		return 0, fmt.Errorf("IOCTL_VOLUME_GET_VOLUME_DISK_EXTENTS failed: %v", err)
+	}
+	if extents.NumberOfDiskExtents == 0 {
+		return 0, fmt.Errorf("volume has no disk extents")
+	}
+	return extents.DiskNumber, nil
+}
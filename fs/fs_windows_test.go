@@ -0,0 +1,43 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+package fs
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestVolumeDiskExtentsLayout guards against the Go struct drifting out of
+// sync with the real Win32 VOLUME_DISK_EXTENTS layout, where the embedded
+// DISK_EXTENT's LARGE_INTEGER members force 8-byte alignment and therefore
+// padding that a naive field-for-field translation misses.
+func TestVolumeDiskExtentsLayout(t *testing.T) {
+	var extents volumeDiskExtents
+
+	if got, want := unsafe.Offsetof(extents.DiskNumber), uintptr(8); got != want {
+		t.Errorf("offsetof(DiskNumber) = %d, want %d", got, want)
+	}
+	if got, want := unsafe.Offsetof(extents.StartingOffset), uintptr(16); got != want {
+		t.Errorf("offsetof(StartingOffset) = %d, want %d", got, want)
+	}
+	if got, want := unsafe.Offsetof(extents.ExtentLength), uintptr(24); got != want {
+		t.Errorf("offsetof(ExtentLength) = %d, want %d", got, want)
+	}
+	if got, want := unsafe.Sizeof(extents), uintptr(32); got != want {
+		t.Errorf("sizeof(volumeDiskExtents) = %d, want %d", got, want)
+	}
+}
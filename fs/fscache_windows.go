@@ -0,0 +1,52 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+package fs
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// windowsFsStatsCache queries capacity directly from the volume on every
+// call - GetDiskFreeSpaceExW is cheap enough that NTFS/ReFS don't need the
+// caching that the Linux implementation uses to avoid repeated statfs(2)
+// calls across many bind mounts of the same filesystem.
+type windowsFsStatsCache struct{}
+
+func NewFsStatsCache() FsStatsCache {
+	return &windowsFsStatsCache{}
+}
+
+func (self *windowsFsStatsCache) Clear() {}
+
+func (self *windowsFsStatsCache) FsStats(dev string, part partition) (FsType, uint64, uint64, uint64, uint64, uint64, error) {
+	devp, err := windows.UTF16PtrFromString(dev)
+	if err != nil {
+		return "", 0, 0, 0, 0, 0, err
+	}
+
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(devp, &free, &total, &totalFree); err != nil {
+		return "", 0, 0, 0, 0, 0, fmt.Errorf("GetDiskFreeSpaceEx failed for %q: %v", dev, err)
+	}
+
+	// NTFS/ReFS don't expose a fixed inode table the way ext-family
+	// filesystems do, so there's no meaningful total/free inode count to
+	// report.
+	return FsType(part.fsType), total, totalFree, free, 0, 0, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package fs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// legacyPartitionRegex is the pre-sysfs device allow-list. It only covers
+// SCSI/SATA (sd*), Xen (xvd*) and device-mapper (dm-N) devices, so it
+// silently drops /proc/diskstats rows for NVMe, eMMC, MD RAID, loop, and
+// virtio devices. It's kept as a fallback for the (rare) case where
+// /sys/block isn't mounted in cAdvisor's mount namespace.
+var legacyPartitionRegex = regexp.MustCompile(`^(?:(?:s|xv)d[a-z]+\d*|dm-\d+)$`)
+
+// blockDeviceAllowList enumerates sysfsBlockDir and returns the set of
+// /proc/diskstats device names worth keeping: every top-level entry the
+// kernel lists as a block device there (sd*, xvd*, dm-*, nvme*n*, mmcblk*,
+// md*, loop*, vd*, ...) plus each of their partitions, matching how modern
+// container runtimes lay out storage on cloud and edge hardware. ok is
+// false when sysfsBlockDir can't be read, so the caller can fall back to
+// legacyPartitionRegex.
+func blockDeviceAllowList(sysfsBlockDir string) (allowed map[string]bool, ok bool) {
+	disks, err := ioutil.ReadDir(sysfsBlockDir)
+	if err != nil {
+		return nil, false
+	}
+
+	allowed = make(map[string]bool, len(disks))
+	for _, disk := range disks {
+		allowed[disk.Name()] = true
+
+		partitions, err := ioutil.ReadDir(filepath.Join(sysfsBlockDir, disk.Name()))
+		if err != nil {
+			continue
+		}
+		for _, partition := range partitions {
+			// Partitions of a disk are exposed as subdirectories of it
+			// named <disk><partition-suffix>, e.g. sda/sda1, nvme0n1/
+			// nvme0n1p1, mmcblk0/mmcblk0p1.
+			if partition.IsDir() && strings.HasPrefix(partition.Name(), disk.Name()) {
+				allowed[partition.Name()] = true
+			}
+		}
+	}
+	return allowed, true
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/windows"
+)
+
+// windowsPartitionCache enumerates NTFS/ReFS volumes via the Win32 volume
+// APIs. Windows has no major/minor device numbers, so major is always 0 and
+// minor is a monotonically increasing index assigned the first time a volume
+// is seen. A volume keeps its minor across Refresh calls while it stays
+// listed; Clear forgets the assignments, and a volume seen again afterwards
+// gets a new one.
+type windowsPartitionCache struct {
+	context Context
+
+	mu         sync.RWMutex
+	partitions map[string]partition
+	labels     map[string]string
+	nextMinor  uint
+}
+
+func NewPartitionCache(context Context) PartitionCache {
+	cache := &windowsPartitionCache{
+		context:    context,
+		partitions: make(map[string]partition),
+		labels:     make(map[string]string),
+	}
+	if err := cache.Refresh(); err != nil {
+		glog.Warningf("Failed to list volumes: %v", err)
+	}
+	return cache
+}
+
+func (self *windowsPartitionCache) Clear() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.partitions = make(map[string]partition)
+	self.labels = make(map[string]string)
+}
+
+func (self *windowsPartitionCache) Refresh() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	partitions := make(map[string]partition)
+	labels := make(map[string]string)
+
+	var volumeName [windows.MAX_PATH]uint16
+	handle, err := windows.FindFirstVolume(&volumeName[0], uint32(len(volumeName)))
+	if err != nil {
+		return fmt.Errorf("FindFirstVolume failed: %v", err)
+	}
+	defer windows.FindVolumeClose(handle)
+
+	for {
+		device := windows.UTF16ToString(volumeName[:])
+		mountpoint, fsType, label, err := volumeInfo(device)
+		if err == nil && mountpoint != "" {
+			minor, ok := self.minorForDevice(device)
+			if !ok {
+				minor = self.nextMinor
+				self.nextMinor++
+			}
+			partitions[device] = partition{
+				mountpoint: mountpoint,
+				major:      0,
+				minor:      minor,
+				fsType:     fsType,
+				blockSize:  0,
+			}
+			if label != "" {
+				labels[label] = device
+			}
+		}
+
+		err = windows.FindNextVolume(handle, &volumeName[0], uint32(len(volumeName)))
+		if err != nil {
+			if err == windows.ERROR_NO_MORE_FILES {
+				break
+			}
+			return fmt.Errorf("FindNextVolume failed: %v", err)
+		}
+	}
+
+	// Container storage lives under the windowsfilter graph driver
+	// directory, which isn't itself a distinct volume - alias it to the
+	// volume that backs the docker root so per-container stats resolve.
+	if root := dockerWindowsfilterRoot(self.context.Docker); root != "" {
+		if device, err := volumeNameForPath(root); err == nil {
+			if p, ok := partitions[device]; ok {
+				p.mountpoint = root
+				partitions[device] = p
+			}
+		}
+	}
+
+	self.partitions = partitions
+	self.labels = labels
+	return nil
+}
+
+// minorForDevice returns the minor number already assigned to device, if
+// any, so Refresh doesn't reassign numbers to volumes it has already seen.
+func (self *windowsPartitionCache) minorForDevice(device string) (uint, bool) {
+	p, ok := self.partitions[device]
+	return p.minor, ok
+}
+
+func (self *windowsPartitionCache) PartitionForDevice(device string) (partition, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	p, ok := self.partitions[device]
+	if !ok {
+		return partition{}, fmt.Errorf("no partition info for device %q", device)
+	}
+	return p, nil
+}
+
+func (self *windowsPartitionCache) DeviceInfoForMajorMinor(major uint, minor uint) (*DeviceInfo, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for device, p := range self.partitions {
+		if p.major == major && p.minor == minor {
+			return &DeviceInfo{Device: device, Major: major, Minor: minor}, nil
+		}
+	}
+	return nil, fmt.Errorf("no device with major=%d, minor=%d", major, minor)
+}
+
+func (self *windowsPartitionCache) ApplyOverPartitions(f func(device string, p partition) error) error {
+	self.mu.RLock()
+	partitions := make(map[string]partition, len(self.partitions))
+	for device, p := range self.partitions {
+		partitions[device] = p
+	}
+	self.mu.RUnlock()
+
+	for device, p := range partitions {
+		if err := f(device, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *windowsPartitionCache) DeviceNameForLabel(label string) (string, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	device, ok := self.labels[label]
+	if !ok {
+		return "", fmt.Errorf("no device for label %q", label)
+	}
+	return device, nil
+}
+
+func (self *windowsPartitionCache) ApplyOverLabels(f func(label string, device string) error) error {
+	self.mu.RLock()
+	labels := make(map[string]string, len(self.labels))
+	for label, device := range self.labels {
+		labels[label] = device
+	}
+	self.mu.RUnlock()
+
+	for label, device := range labels {
+		if err := f(label, device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volumeInfo returns the first mount point, filesystem name, and volume
+// label for a `\\?\Volume{GUID}\` device path.
+func volumeInfo(device string) (mountpoint, fsType, label string, err error) {
+	devicep, err := windows.UTF16PtrFromString(device)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	var returnLen uint32
+	pathNames := make([]uint16, windows.MAX_PATH)
+	if err := windows.GetVolumePathNamesForVolumeName(devicep, &pathNames[0], uint32(len(pathNames)), &returnLen); err != nil {
+		return "", "", "", err
+	}
+	for _, p := range strings.Split(windows.UTF16ToString(pathNames), "\x00") {
+		if p != "" {
+			mountpoint = p
+			break
+		}
+	}
+	if mountpoint == "" {
+		return "", "", "", nil
+	}
+
+	var labelBuf, fsBuf [windows.MAX_PATH]uint16
+	var serial, maxComponentLen, flags uint32
+	if err := windows.GetVolumeInformation(devicep, &labelBuf[0], uint32(len(labelBuf)),
+		&serial, &maxComponentLen, &flags, &fsBuf[0], uint32(len(fsBuf))); err != nil {
+		return mountpoint, "", "", nil
+	}
+
+	return mountpoint, windows.UTF16ToString(fsBuf[:]), windows.UTF16ToString(labelBuf[:]), nil
+}
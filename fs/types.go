@@ -24,6 +24,21 @@ type partition struct {
 	blockSize  uint
 }
 
+// Context carries host-specific information needed to build a FsInfo, such
+// as where the container runtime keeps its storage. It is shared by every
+// platform's NewFsInfo.
+type Context struct {
+	// docker root directory.
+	Docker  DockerContext
+	RktPath string
+}
+
+type DockerContext struct {
+	Root         string
+	Driver       string
+	DriverStatus map[string]string
+}
+
 type DeviceInfo struct {
 	Device string
 	Major  uint
@@ -44,13 +59,21 @@ const (
 
 type Fs struct {
 	DeviceInfo
-	Type       FsType
-	Capacity   uint64
-	Free       uint64
-	Available  uint64
-	Inodes     uint64
-	InodesFree uint64
-	DiskStats  DiskStats
+	Type FsType
+	// BackingDevice identifies the physical block device that the mounted
+	// device in DeviceInfo is ultimately layered on, when the two differ -
+	// e.g. a dm-crypt/LUKS mapping or an ecryptfs mount whose lower
+	// filesystem doesn't itself appear in /proc/diskstats. It is only looked
+	// up when disk stats are requested (withIoStats), so it is nil whenever
+	// they are not, and also when DeviceInfo already refers to a device with
+	// its own disk stats.
+	BackingDevice *DeviceInfo
+	Capacity      uint64
+	Free          uint64
+	Available     uint64
+	Inodes        uint64
+	InodesFree    uint64
+	DiskStats     DiskStats
 }
 
 type DiskStats struct {